@@ -4,9 +4,28 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/Azure/azure-sdk-for-go/services/graphrbac/1.6/graphrbac"
+	"github.com/Azure/go-autorest/autorest"
+)
+
+const (
+	groupMembershipMaxAttempts = 10
+	groupMembershipBaseDelay   = 2 * time.Second
+	groupMembershipMaxDelay    = 60 * time.Second
+	groupMembershipConcurrency = 10
+
+	// groupReconcileMaxAttempts/groupReconcileMaxDelay bound the per-member
+	// backoff used while reconciling hundreds of members concurrently, since
+	// groupMembershipMaxDelay's 60s cap is sized for a single GroupAddMember
+	// call, not for hundreds of calls sharing groupMembershipConcurrency slots.
+	groupReconcileMaxAttempts = 5
+	groupReconcileMaxDelay    = 10 * time.Second
 )
 
 type GroupMemberId struct {
@@ -36,8 +55,43 @@ func ParseGroupMemberId(idString string) (GroupMemberId, error) {
 	}, nil
 }
 
-func GroupGetByDisplayName(client *graphrbac.GroupsClient, ctx context.Context, displayName string) (*graphrbac.ADGroup, error) {
-	filter := fmt.Sprintf("displayName eq '%s'", displayName)
+type GroupSearchCriteria struct {
+	DisplayName     *string
+	MailNickname    *string
+	ObjectID        *string
+	SecurityEnabled *bool
+}
+
+func (c GroupSearchCriteria) filter() string {
+	clauses := make([]string, 0, 4)
+
+	if c.DisplayName != nil {
+		clauses = append(clauses, fmt.Sprintf("displayName eq '%s'", escapeODataFilterValue(*c.DisplayName)))
+	}
+	if c.MailNickname != nil {
+		clauses = append(clauses, fmt.Sprintf("mailNickname eq '%s'", escapeODataFilterValue(*c.MailNickname)))
+	}
+	if c.ObjectID != nil {
+		clauses = append(clauses, fmt.Sprintf("objectId eq '%s'", escapeODataFilterValue(*c.ObjectID)))
+	}
+	if c.SecurityEnabled != nil {
+		clauses = append(clauses, fmt.Sprintf("securityEnabled eq %t", *c.SecurityEnabled))
+	}
+
+	return strings.Join(clauses, " and ")
+}
+
+// escapeODataFilterValue doubles single quotes so value can't break out of the filter literal.
+func escapeODataFilterValue(value string) string {
+	return strings.ReplaceAll(value, "'", "''")
+}
+
+// GroupFind returns (nil, nil) on no match, leaving not-found handling to the caller.
+func GroupFind(client graphrbac.GroupsClient, ctx context.Context, criteria GroupSearchCriteria) (*graphrbac.ADGroup, error) {
+	filter := criteria.filter()
+	if filter == "" {
+		return nil, fmt.Errorf("no search criteria supplied for Azure AD Group lookup")
+	}
 
 	resp, err := client.ListComplete(ctx, filter)
 	if err != nil {
@@ -45,17 +99,28 @@ func GroupGetByDisplayName(client *graphrbac.GroupsClient, ctx context.Context,
 	}
 
 	values := resp.Response().Value
-	if values == nil {
-		return nil, fmt.Errorf("nil values for AD Groups matching %q", filter)
+	if values == nil || len(*values) == 0 {
+		return nil, nil
 	}
-	if len(*values) == 0 {
-		return nil, fmt.Errorf("found no AD Groups matching %q", filter)
-	}
-	if len(*values) > 2 {
+	if len(*values) > 1 {
 		return nil, fmt.Errorf("found multiple AD Groups matching %q", filter)
 	}
 
 	group := (*values)[0]
+	return &group, nil
+}
+
+func GroupGetByDisplayName(client *graphrbac.GroupsClient, ctx context.Context, displayName string) (*graphrbac.ADGroup, error) {
+	filter := fmt.Sprintf("displayName eq '%s'", escapeODataFilterValue(displayName))
+
+	group, err := GroupFind(*client, ctx, GroupSearchCriteria{DisplayName: &displayName})
+	if err != nil {
+		return nil, err
+	}
+	if group == nil {
+		return nil, fmt.Errorf("found no AD Groups matching %q", filter)
+	}
+
 	if group.DisplayName == nil {
 		return nil, fmt.Errorf("nil DisplayName for AD Groups matching %q", filter)
 	}
@@ -63,7 +128,7 @@ func GroupGetByDisplayName(client *graphrbac.GroupsClient, ctx context.Context,
 		return nil, fmt.Errorf("displayname for AD Groups matching %q does is does not match(%q!=%q)", filter, *group.DisplayName, displayName)
 	}
 
-	return &group, nil
+	return group, nil
 }
 
 func DirectoryObjectListToIDs(objects graphrbac.DirectoryObjectListResultIterator, ctx context.Context) ([]string, error) {
@@ -97,6 +162,74 @@ func DirectoryObjectListToIDs(objects graphrbac.DirectoryObjectListResultIterato
 	return ids, nil
 }
 
+type DirectoryMemberType string
+
+const (
+	DirectoryMemberTypeUser             DirectoryMemberType = "User"
+	DirectoryMemberTypeGroup            DirectoryMemberType = "Group"
+	DirectoryMemberTypeServicePrincipal DirectoryMemberType = "ServicePrincipal"
+)
+
+type DirectoryMember struct {
+	ObjectID            string
+	Type                DirectoryMemberType
+	DisplayName         string
+	SecondaryIdentifier string
+}
+
+func DirectoryObjectListToTyped(objects graphrbac.DirectoryObjectListResultIterator, ctx context.Context) ([]DirectoryMember, error) {
+	members := make([]DirectoryMember, 0)
+	for objects.NotDone() {
+		if member, ok := decodeDirectoryMember(objects.Value()); ok {
+			members = append(members, member)
+		}
+
+		if err := objects.NextWithContext(ctx); err != nil {
+			return nil, fmt.Errorf("during pagination of directory objects: %+v", err)
+		}
+	}
+
+	return members, nil
+}
+
+func decodeDirectoryMember(v graphrbac.BasicDirectoryObject) (DirectoryMember, bool) {
+	if user, _ := v.AsUser(); user != nil {
+		return DirectoryMember{
+			ObjectID:            *user.ObjectID,
+			Type:                DirectoryMemberTypeUser,
+			DisplayName:         stringOrEmpty(user.DisplayName),
+			SecondaryIdentifier: stringOrEmpty(user.UserPrincipalName),
+		}, true
+	}
+
+	if group, _ := v.AsADGroup(); group != nil {
+		return DirectoryMember{
+			ObjectID:            *group.ObjectID,
+			Type:                DirectoryMemberTypeGroup,
+			DisplayName:         stringOrEmpty(group.DisplayName),
+			SecondaryIdentifier: stringOrEmpty(group.Mail),
+		}, true
+	}
+
+	if servicePrincipal, _ := v.AsServicePrincipal(); servicePrincipal != nil {
+		return DirectoryMember{
+			ObjectID:            *servicePrincipal.ObjectID,
+			Type:                DirectoryMemberTypeServicePrincipal,
+			DisplayName:         stringOrEmpty(servicePrincipal.DisplayName),
+			SecondaryIdentifier: stringOrEmpty(servicePrincipal.AppID),
+		}, true
+	}
+
+	return DirectoryMember{}, false
+}
+
+func stringOrEmpty(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
 func GroupAllMembers(client graphrbac.GroupsClient, ctx context.Context, groupId string) ([]string, error) {
 	members, err := client.GetGroupMembersComplete(ctx, groupId)
 
@@ -114,6 +247,162 @@ func GroupAllMembers(client graphrbac.GroupsClient, ctx context.Context, groupId
 	return existingMembers, nil
 }
 
+// GroupAllTransitiveMembers walks nested groups client-side since the Azure AD Graph API has no transitiveMembers endpoint.
+func GroupAllTransitiveMembers(client graphrbac.GroupsClient, ctx context.Context, groupId string) ([]string, error) {
+	visitedGroups := map[string]struct{}{groupId: {}}
+	members := make(map[string]struct{})
+
+	if err := groupCollectTransitiveMembers(client, ctx, groupId, visitedGroups, members); err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(members))
+	for id := range members {
+		ids = append(ids, id)
+	}
+
+	log.Printf("[DEBUG] %d transitive members in Azure AD group with ID: %q", len(ids), groupId)
+
+	return ids, nil
+}
+
+// groupCollectTransitiveMembers requires groupId already be in visitedGroups,
+// so a cycle between groups (A contains B, B contains A) terminates instead
+// of re-walking forever, independent of Azure AD preventing such cycles.
+func groupCollectTransitiveMembers(client graphrbac.GroupsClient, ctx context.Context, groupId string, visitedGroups map[string]struct{}, members map[string]struct{}) error {
+	list, err := client.GetGroupMembersComplete(ctx, groupId)
+	if err != nil {
+		return fmt.Errorf("listing members of Azure AD Group with ID %q: %+v", groupId, err)
+	}
+
+	for list.NotDone() {
+		v := list.Value()
+
+		if user, _ := v.AsUser(); user != nil {
+			members[*user.ObjectID] = struct{}{}
+		}
+
+		if servicePrincipal, _ := v.AsServicePrincipal(); servicePrincipal != nil {
+			members[*servicePrincipal.ObjectID] = struct{}{}
+		}
+
+		if group, _ := v.AsADGroup(); group != nil {
+			members[*group.ObjectID] = struct{}{}
+			if _, visited := visitedGroups[*group.ObjectID]; !visited {
+				visitedGroups[*group.ObjectID] = struct{}{}
+				if err := groupCollectTransitiveMembers(client, ctx, *group.ObjectID, visitedGroups, members); err != nil {
+					return err
+				}
+			}
+		}
+
+		if err := list.NextWithContext(ctx); err != nil {
+			return fmt.Errorf("during pagination of members for Azure AD Group with ID %q: %+v", groupId, err)
+		}
+	}
+
+	return nil
+}
+
+// GroupAdministrativeUnitMemberships errors: the vendored graphrbac client has no administrativeUnit/memberOf surface.
+func GroupAdministrativeUnitMemberships(client graphrbac.GroupsClient, ctx context.Context, groupId string) ([]string, error) {
+	return nil, fmt.Errorf("administrative unit memberships are not available for Azure AD Group with ID %q: the vendored graphrbac client has no administrativeUnit/memberOf surface", groupId)
+}
+
+// retryWithBackoff retries f with exponential backoff capped at maxDelay, honoring Retry-After on 429/5xx.
+func retryWithBackoff(attempts int, maxDelay time.Duration, f func() (autorest.Response, error)) error {
+	delay := groupMembershipBaseDelay
+
+	for i := 0; i < attempts; i++ {
+		resp, err := f()
+		if err == nil {
+			return nil
+		}
+
+		retryAfter := delay
+		if resp.Response != nil {
+			status := resp.StatusCode
+			if status != http.StatusTooManyRequests && status < http.StatusInternalServerError {
+				return err
+			}
+			if header := resp.Header.Get("Retry-After"); header != "" {
+				if seconds, parseErr := strconv.Atoi(header); parseErr == nil {
+					retryAfter = time.Duration(seconds) * time.Second
+				}
+			}
+		}
+		if retryAfter > maxDelay {
+			retryAfter = maxDelay
+		}
+
+		if i == attempts-1 {
+			return err
+		}
+
+		time.Sleep(retryAfter)
+		delay *= 2
+		if delay > maxDelay {
+			delay = maxDelay
+		}
+	}
+
+	return nil
+}
+
+// runConcurrently calls fn for each id, up to groupMembershipConcurrency at
+// once, and returns the first error seen once every call has finished.
+func runConcurrently(ids []string, fn func(id string) error) error {
+	sem := make(chan struct{}, groupMembershipConcurrency)
+	errs := make([]error, len(ids))
+
+	var wg sync.WaitGroup
+	for i, id := range ids {
+		i, id := i, id
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			errs[i] = fn(id)
+		}()
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func diffMembers(desired, existing []string) (toAdd []string, toRemove []string) {
+	desiredSet := make(map[string]struct{}, len(desired))
+	for _, id := range desired {
+		desiredSet[id] = struct{}{}
+	}
+
+	existingSet := make(map[string]struct{}, len(existing))
+	for _, id := range existing {
+		existingSet[id] = struct{}{}
+	}
+
+	for _, id := range desired {
+		if _, ok := existingSet[id]; !ok {
+			toAdd = append(toAdd, id)
+		}
+	}
+
+	for _, id := range existing {
+		if _, ok := desiredSet[id]; !ok {
+			toRemove = append(toRemove, id)
+		}
+	}
+
+	return toAdd, toRemove
+}
+
 func GroupAddMember(client graphrbac.GroupsClient, ctx context.Context, groupId string, member string) error {
 	memberGraphURL := fmt.Sprintf("https://graph.windows.net/%s/directoryObjects/%s", client.TenantID, member)
 
@@ -122,16 +411,10 @@ func GroupAddMember(client graphrbac.GroupsClient, ctx context.Context, groupId
 	}
 
 	log.Printf("[DEBUG] Adding member with id %q to Azure AD group with id %q", member, groupId)
-	var err error
-	attempts := 10
-	for i := 0; i <= attempts; i++ {
-		if _, err = client.AddMember(ctx, groupId, properties); err == nil {
-			break
-		}
-		if i == attempts {
-			return fmt.Errorf("adding group member %q to Azure AD Group with ID %q: %+v", member, groupId, err)
-		}
-		time.Sleep(time.Second * 2)
+	if err := retryWithBackoff(groupMembershipMaxAttempts, groupMembershipMaxDelay, func() (autorest.Response, error) {
+		return client.AddMember(ctx, groupId, properties)
+	}); err != nil {
+		return fmt.Errorf("adding group member %q to Azure AD Group with ID %q: %+v", member, groupId, err)
 	}
 
 	if _, err := WaitForListAdd(member, func() ([]string, error) {
@@ -143,6 +426,55 @@ func GroupAddMember(client graphrbac.GroupsClient, ctx context.Context, groupId
 	return nil
 }
 
+// GroupSetMembers reconciles membership to desiredMembers, confirming each add/remove via WaitForListAdd/WaitForListRemove.
+func GroupSetMembers(client graphrbac.GroupsClient, ctx context.Context, groupId string, desiredMembers []string) error {
+	existingMembers, err := GroupAllMembers(client, ctx, groupId)
+	if err != nil {
+		return fmt.Errorf("listing existing members of Azure AD Group with ID %q: %+v", groupId, err)
+	}
+
+	membersToAdd, membersToRemove := diffMembers(desiredMembers, existingMembers)
+
+	if err := runConcurrently(membersToAdd, func(member string) error {
+		memberGraphURL := fmt.Sprintf("https://graph.windows.net/%s/directoryObjects/%s", client.TenantID, member)
+		properties := graphrbac.GroupAddMemberParameters{URL: &memberGraphURL}
+
+		log.Printf("[DEBUG] Adding member with id %q to Azure AD group with id %q", member, groupId)
+		if err := retryWithBackoff(groupReconcileMaxAttempts, groupReconcileMaxDelay, func() (autorest.Response, error) {
+			return client.AddMember(ctx, groupId, properties)
+		}); err != nil {
+			return fmt.Errorf("adding group member %q to Azure AD Group with ID %q: %+v", member, groupId, err)
+		}
+
+		if _, err := WaitForListAdd(member, func() ([]string, error) {
+			return GroupAllMembers(client, ctx, groupId)
+		}); err != nil {
+			return fmt.Errorf("waiting for group membership: %+v", err)
+		}
+
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	return runConcurrently(membersToRemove, func(member string) error {
+		log.Printf("[DEBUG] Removing member with id %q from Azure AD group with id %q", member, groupId)
+		if err := retryWithBackoff(groupReconcileMaxAttempts, groupReconcileMaxDelay, func() (autorest.Response, error) {
+			return client.RemoveMember(ctx, groupId, member)
+		}); err != nil {
+			return fmt.Errorf("removing group member %q from Azure AD Group with ID %q: %+v", member, groupId, err)
+		}
+
+		if _, err := WaitForListRemove(member, func() ([]string, error) {
+			return GroupAllMembers(client, ctx, groupId)
+		}); err != nil {
+			return fmt.Errorf("waiting for group member removal: %+v", err)
+		}
+
+		return nil
+	})
+}
+
 func GroupAddMembers(client graphrbac.GroupsClient, ctx context.Context, groupId string, members []string) error {
 	for _, memberUuid := range members {
 		err := GroupAddMember(client, ctx, groupId, memberUuid)
@@ -186,6 +518,55 @@ func GroupAddOwner(client graphrbac.GroupsClient, ctx context.Context, groupId s
 	return nil
 }
 
+// GroupSetOwners is the owner-side equivalent of GroupSetMembers.
+func GroupSetOwners(client graphrbac.GroupsClient, ctx context.Context, groupId string, desiredOwners []string) error {
+	existingOwners, err := GroupAllOwners(client, ctx, groupId)
+	if err != nil {
+		return fmt.Errorf("listing existing owners of Azure AD Group with ID %q: %+v", groupId, err)
+	}
+
+	ownersToAdd, ownersToRemove := diffMembers(desiredOwners, existingOwners)
+
+	if err := runConcurrently(ownersToAdd, func(owner string) error {
+		ownerGraphURL := fmt.Sprintf("https://graph.windows.net/%s/directoryObjects/%s", client.TenantID, owner)
+		properties := graphrbac.AddOwnerParameters{URL: &ownerGraphURL}
+
+		log.Printf("[DEBUG] Adding owner with id %q to Azure AD group with id %q", owner, groupId)
+		if err := retryWithBackoff(groupReconcileMaxAttempts, groupReconcileMaxDelay, func() (autorest.Response, error) {
+			return client.AddOwner(ctx, groupId, properties)
+		}); err != nil {
+			return fmt.Errorf("adding group owner %q to Azure AD Group with ID %q: %+v", owner, groupId, err)
+		}
+
+		if _, err := WaitForListAdd(owner, func() ([]string, error) {
+			return GroupAllOwners(client, ctx, groupId)
+		}); err != nil {
+			return fmt.Errorf("waiting for group ownership: %+v", err)
+		}
+
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	return runConcurrently(ownersToRemove, func(owner string) error {
+		log.Printf("[DEBUG] Removing owner with id %q from Azure AD group with id %q", owner, groupId)
+		if err := retryWithBackoff(groupReconcileMaxAttempts, groupReconcileMaxDelay, func() (autorest.Response, error) {
+			return client.RemoveOwner(ctx, groupId, owner)
+		}); err != nil {
+			return fmt.Errorf("removing group owner %q from Azure AD Group with ID %q: %+v", owner, groupId, err)
+		}
+
+		if _, err := WaitForListRemove(owner, func() ([]string, error) {
+			return GroupAllOwners(client, ctx, groupId)
+		}); err != nil {
+			return fmt.Errorf("waiting for group owner removal: %+v", err)
+		}
+
+		return nil
+	})
+}
+
 func GroupAddOwners(client graphrbac.GroupsClient, ctx context.Context, groupId string, owner []string) error {
 	for _, ownerUuid := range owner {
 		err := GroupAddOwner(client, ctx, groupId, ownerUuid)
@@ -198,21 +579,10 @@ func GroupAddOwners(client graphrbac.GroupsClient, ctx context.Context, groupId
 	return nil
 }
 
+// GroupFindByName delegates to GroupFind with a displayName filter: it returns (nil, nil) when no group
+// matches and an error when more than one does. Only the first page of the listing is examined.
 func GroupFindByName(client graphrbac.GroupsClient, ctx context.Context, name string) (*graphrbac.ADGroup, error) {
-	nameFilter := fmt.Sprintf("displayName eq '%s'", name)
-	resp, err := client.List(ctx, nameFilter)
-
-	if err != nil {
-		return nil, fmt.Errorf("unable to list Groups with filter %q: %+v", nameFilter, err)
-	}
-
-	for _, group := range resp.Values() {
-		if *group.DisplayName == name {
-			return &group, nil
-		}
-	}
-
-	return nil, nil
+	return GroupFind(client, ctx, GroupSearchCriteria{DisplayName: &name})
 }
 
 func GroupCheckNameAvailability(client graphrbac.GroupsClient, ctx context.Context, name string) error {